@@ -0,0 +1,77 @@
+package main
+
+import (
+	"container/ring"
+	"sync"
+)
+
+// broadcastWriter is an io.Writer that fans written chunks out to any number
+// of live subscribers (e.g. the /logs websocket) while also keeping a bounded
+// ring buffer of recent output so a subscriber that connects late still sees
+// some history. Subscribers are buffered channels; a slow subscriber has
+// writes dropped for it rather than blocking the process being captured.
+type broadcastWriter struct {
+	mu   sync.Mutex
+	hist *ring.Ring
+	subs map[chan []byte]struct{}
+}
+
+func newBroadcastWriter(historyLines int) *broadcastWriter {
+	return &broadcastWriter{
+		hist: ring.New(historyLines),
+		subs: make(map[chan []byte]struct{}),
+	}
+}
+
+func (b *broadcastWriter) Write(p []byte) (int, error) {
+	line := make([]byte, len(p))
+	copy(line, p)
+
+	b.mu.Lock()
+	b.hist.Value = line
+	b.hist = b.hist.Next()
+	for ch := range b.subs {
+		select {
+		case ch <- line:
+		default:
+			// Slow subscriber, drop instead of blocking the child process.
+		}
+	}
+	b.mu.Unlock()
+	return len(p), nil
+}
+
+// subscribe registers a new channel that receives every chunk written from
+// now on. The caller must call unsubscribe when done reading.
+func (b *broadcastWriter) subscribe() chan []byte {
+	ch := make(chan []byte, 64)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *broadcastWriter) unsubscribe(ch chan []byte) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+	close(ch)
+}
+
+// history returns the buffered output collected so far, oldest first.
+func (b *broadcastWriter) history() []byte {
+	var buf []byte
+	b.mu.Lock()
+	b.hist.Do(func(v interface{}) {
+		if v == nil {
+			return
+		}
+		buf = append(buf, v.([]byte)...)
+	})
+	b.mu.Unlock()
+	return buf
+}
+
+func (b *broadcastWriter) String() string {
+	return string(b.history())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBroadcastWriterHistoryOrdering(t *testing.T) {
+	b := newBroadcastWriter(3)
+	b.Write([]byte("one"))
+	b.Write([]byte("two"))
+	b.Write([]byte("three"))
+	b.Write([]byte("four"))
+
+	got := b.String()
+	want := "twothreefour"
+	if got != want {
+		t.Fatalf("history() = %q, want %q (oldest entry should have been evicted)", got, want)
+	}
+}
+
+func TestBroadcastWriterSubscribeReceivesNewWrites(t *testing.T) {
+	b := newBroadcastWriter(10)
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	b.Write([]byte("hello"))
+
+	select {
+	case line := <-ch:
+		if string(line) != "hello" {
+			t.Fatalf("subscriber got %q, want %q", line, "hello")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber never received the write")
+	}
+}
+
+func TestBroadcastWriterDropsForSlowSubscriber(t *testing.T) {
+	b := newBroadcastWriter(10)
+	ch := b.subscribe()
+	defer b.unsubscribe(ch)
+
+	// The subscriber channel has a small fixed buffer; writing past it must
+	// drop for that subscriber instead of blocking the writer.
+	for i := 0; i < 1000; i++ {
+		if _, err := b.Write([]byte("x")); nil != err {
+			t.Fatalf("Write returned error: %v", err)
+		}
+	}
+
+	if got := b.String(); len(got) == 0 {
+		t.Fatal("history should still record writes even once a subscriber falls behind")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const logsPageHTML = `<!DOCTYPE html>
+<html>
+<head><title>brooktool logs</title></head>
+<body>
+<pre id="logs" style="white-space: pre-wrap; font-family: monospace;"></pre>
+<script>
+var logs = document.getElementById("logs");
+var ws = new WebSocket("ws://" + location.host + "/logs");
+ws.onmessage = function(evt) {
+	logs.textContent += evt.data;
+	window.scrollTo(0, document.body.scrollHeight);
+};
+ws.onclose = function() {
+	logs.textContent += "\n[connection closed]\n";
+};
+</script>
+</body>
+</html>
+`
+
+// statusResponse is the payload returned by GET /status.
+type statusResponse struct {
+	Running bool          `json:"running"`
+	Pid     int           `json:"pid"`
+	Server  string        `json:"server"`
+	Uptime  string        `json:"uptime"`
+	PacURL  string        `json:"pac_url"`
+	Servers []serverStats `json:"servers,omitempty"`
+}
+
+// controlHandler exposes the local JSON control API (status/reload/restart)
+// and the /logs websocket on top of the brook subprocess's broadcast writer.
+type controlHandler struct {
+	startTime time.Time
+	pacURL    string
+	logs      *broadcastWriter
+
+	// pid reports the current brook child's pid, or 0 if it isn't running.
+	pid func() int
+	// reload re-downloads the PAC file and re-applies the system proxy.
+	reload func() error
+	// restart kills and respawns the brook client.
+	restart func() error
+	// activeServer reports the brook server currently in use. nil outside
+	// multi-server mode.
+	activeServer func() string
+	// serverStats reports per-server health-check results. nil outside
+	// multi-server mode.
+	serverStats func() []serverStats
+
+	upgrader websocket.Upgrader
+}
+
+func newControlHandler(pacURL string, logs *broadcastWriter, pid func() int, reload, restart func() error, activeServer func() string, serverStats func() []serverStats) *controlHandler {
+	return &controlHandler{
+		startTime:    time.Now(),
+		pacURL:       pacURL,
+		logs:         logs,
+		pid:          pid,
+		reload:       reload,
+		restart:      restart,
+		activeServer: activeServer,
+		serverStats:  serverStats,
+		upgrader: websocket.Upgrader{
+			// The control server only listens on 127.0.0.1, so any origin is fine.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+func (h *controlHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(logsPageHTML))
+	case "/status":
+		h.handleStatus(w, r)
+	case "/reload":
+		h.handleReload(w, r)
+	case "/restart":
+		h.handleRestart(w, r)
+	case "/logs":
+		h.handleLogs(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (h *controlHandler) handleStatus(w http.ResponseWriter, r *http.Request) {
+	pid := h.pid()
+	server := flagServer
+	if nil != h.activeServer {
+		server = h.activeServer()
+	}
+	resp := statusResponse{
+		Running: pid > 0,
+		Pid:     pid,
+		Server:  server,
+		Uptime:  time.Since(h.startTime).Truncate(time.Second).String(),
+		PacURL:  h.pacURL,
+	}
+	if nil != h.serverStats {
+		resp.Servers = h.serverStats()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *controlHandler) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.reload(); nil != err {
+		log.Printf("Reload requested via control API failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *controlHandler) handleRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := h.restart(); nil != err {
+		log.Printf("Restart requested via control API failed: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *controlHandler) handleLogs(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if nil != err {
+		log.Printf("Upgrade /logs websocket failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	if hist := h.logs.history(); len(hist) > 0 {
+		if err := conn.WriteMessage(websocket.TextMessage, hist); nil != err {
+			return
+		}
+	}
+
+	ch := h.logs.subscribe()
+	defer h.logs.unsubscribe(ch)
+
+	// Drain client reads so a client-initiated close is noticed promptly.
+	clientGone := make(chan struct{})
+	go func() {
+		defer close(clientGone)
+		for {
+			if _, _, err := conn.ReadMessage(); nil != err {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, line); nil != err {
+				return
+			}
+		case <-clientGone:
+			return
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// serverStats is the latest health-check result for one configured brook
+// server, classified the same good/unknown/bad way a latency-sorted racing
+// dialer would pick between several candidate endpoints.
+type serverStats struct {
+	Address   string    `json:"address"`
+	Region    string    `json:"region,omitempty"`
+	Weight    int       `json:"weight"`
+	State     string    `json:"state"` // "good", "unknown" or "bad"
+	LatencyMS int64     `json:"latency_ms"`
+	LastCheck time.Time `json:"last_check"`
+
+	latency  time.Duration
+	failures int
+}
+
+// healthChecker periodically probes every configured server with a TCP dial
+// and, if a canary URL is configured, an end-to-end HTTP fetch through a
+// short-lived brook client against that server, caching the latest result
+// per server address.
+type healthChecker struct {
+	servers   []serverConfig
+	binPath   string
+	canaryURL string
+	interval  time.Duration
+	failLimit int
+
+	mu    sync.Mutex
+	stats map[string]*serverStats
+}
+
+func newHealthChecker(servers []serverConfig, binPath, canaryURL string, interval time.Duration, failLimit int) *healthChecker {
+	stats := make(map[string]*serverStats, len(servers))
+	for _, s := range servers {
+		stats[s.Address] = &serverStats{Address: s.Address, Region: s.Region, Weight: s.Weight, State: "unknown"}
+	}
+	return &healthChecker{
+		servers:   servers,
+		binPath:   binPath,
+		canaryURL: canaryURL,
+		interval:  interval,
+		failLimit: failLimit,
+		stats:     stats,
+	}
+}
+
+func (h *healthChecker) run(stop <-chan struct{}) {
+	h.probeAll()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.probeAll()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (h *healthChecker) probeAll() {
+	var wg sync.WaitGroup
+	for _, s := range h.servers {
+		wg.Add(1)
+		go func(s serverConfig) {
+			defer wg.Done()
+			h.probeOne(s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) probeOne(s serverConfig) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", s.Address, 5*time.Second)
+	latency := time.Since(start)
+	if nil != err {
+		h.recordFailure(s.Address, err)
+		return
+	}
+	conn.Close()
+
+	if "" != h.canaryURL {
+		if err := h.probeCanary(s); nil != err {
+			h.recordFailure(s.Address, err)
+			return
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	st := h.stats[s.Address]
+	st.latency = latency
+	st.LatencyMS = latency.Milliseconds()
+	st.failures = 0
+	st.State = "good"
+	st.LastCheck = time.Now()
+}
+
+// markFailed forces a server bad, used when the brook client running
+// against it exits unexpectedly rather than when a probe fails.
+func (h *healthChecker) markFailed(addr string) {
+	h.mu.Lock()
+	if st, ok := h.stats[addr]; ok && st.failures < h.failLimit-1 {
+		st.failures = h.failLimit - 1
+	}
+	h.mu.Unlock()
+	h.recordFailure(addr, fmt.Errorf("brook client exited"))
+}
+
+func (h *healthChecker) recordFailure(addr string, err error) {
+	h.mu.Lock()
+	st, ok := h.stats[addr]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	st.failures++
+	st.LastCheck = time.Now()
+	if st.failures >= h.failLimit {
+		st.State = "bad"
+	} else if st.State != "good" {
+		st.State = "unknown"
+	}
+	h.mu.Unlock()
+	log.Printf("Health check for %s failed: %v", addr, err)
+}
+
+// probeCanary spins up a throwaway brook client against s on a loopback
+// port, fetches canaryURL through it, and tears it down again.
+func (h *healthChecker) probeCanary(s serverConfig) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		return err
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.binPath, "client",
+		"--ip", "127.0.0.1",
+		"--listen", addr,
+		"--server", s.Address,
+		"--password", s.Password,
+	)
+	if err := cmd.Start(); nil != err {
+		return fmt.Errorf("start probe client: %v", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// Give the probe client a moment to start listening.
+	time.Sleep(300 * time.Millisecond)
+
+	dialer, err := proxy.SOCKS5("tcp", addr, nil, proxy.Direct)
+	if nil != err {
+		return fmt.Errorf("build socks5 dialer: %v", err)
+	}
+	client := &http.Client{
+		Transport: &http.Transport{Dial: dialer.Dial},
+		Timeout:   5 * time.Second,
+	}
+
+	rsp, err := client.Get(h.canaryURL)
+	if nil != err {
+		return fmt.Errorf("canary fetch through %s: %v", s.Address, err)
+	}
+	rsp.Body.Close()
+	return nil
+}
+
+// weightedScore ranks a "good" server by latency divided by weight, so a
+// higher-weighted server wins over a lower-weighted one at comparable
+// latency, the same way weight biases the racing dialers that pick between
+// candidate endpoints elsewhere. A server with weight <= 0 is treated as 1.
+func weightedScore(st *serverStats, weight int) float64 {
+	if weight <= 0 {
+		weight = 1
+	}
+	return float64(st.latency) / float64(weight)
+}
+
+// best returns the server currently classified "good" with the lowest
+// weighted latency score, falling back to any "unknown" server if none are
+// known good yet, and skipping anything classified "bad". excluded servers
+// are always skipped.
+func (h *healthChecker) best(excluded map[string]bool) (serverConfig, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var bestGood, bestUnknown *serverStats
+	var bestGoodScore float64
+	for _, s := range h.servers {
+		if excluded[s.Address] {
+			continue
+		}
+		st := h.stats[s.Address]
+		switch st.State {
+		case "good":
+			score := weightedScore(st, s.Weight)
+			if nil == bestGood || score < bestGoodScore {
+				bestGood = st
+				bestGoodScore = score
+			}
+		case "unknown":
+			if nil == bestUnknown {
+				bestUnknown = st
+			}
+		}
+	}
+
+	pick := bestGood
+	if nil == pick {
+		pick = bestUnknown
+	}
+	if nil == pick {
+		return serverConfig{}, false
+	}
+	for _, s := range h.servers {
+		if s.Address == pick.Address {
+			return s, true
+		}
+	}
+	return serverConfig{}, false
+}
+
+// snapshot returns a copy of the current per-server stats for the status API.
+func (h *healthChecker) snapshot() []serverStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make([]serverStats, 0, len(h.servers))
+	for _, s := range h.servers {
+		out = append(out, *h.stats[s.Address])
+	}
+	return out
+}
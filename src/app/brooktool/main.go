@@ -1,9 +1,7 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -17,22 +15,41 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"app/brooktool/sysproxy"
 	"github.com/fsnotify/fsnotify"
 )
 
 var (
-	flagServer   string
-	flagPassword string
-	flagBinPath  string
-	flagPAC      string
-	flagUpdate   bool
+	flagServer          string
+	flagPassword        string
+	flagBinPath         string
+	flagPAC             string
+	flagAutoUpgrade     bool
+	flagUpgradeURL      string
+	flagUpgradePubKey   string
+	flagPACRefresh      time.Duration
+	flagGFWListURL      string
+	flagPACOverrides    string
+	flagServersConfig   string
+	flagCanaryURL       string
+	flagHealthInterval  time.Duration
+	flagHealthFailLimit int
 )
 
+const upgradeCheckInterval = 30 * time.Minute
+
+// serverExcludeCooldown is how long a server stays excluded from failover
+// selection after its client exits, giving the health checker time to
+// reclassify it before it's eligible again.
+const serverExcludeCooldown = time.Minute
+
 const (
 	defaultPAC = "https://blackwhite.txthinking.com/white.pac"
+	socksAddr  = "127.0.0.1:1080"
 )
 
 var (
@@ -69,17 +86,6 @@ func searchExecutableFile(dir string) (string, error) {
 	return "", nil
 }
 
-func Exists(path string) bool {
-	_, err := os.Stat(path)
-	if err != nil {
-		if os.IsExist(err) {
-			return true
-		}
-		return false
-	}
-	return true
-}
-
 type pacHandler struct {
 	mu      sync.Mutex
 	pacData []byte
@@ -107,19 +113,42 @@ func (h *pacHandler) reload() error {
 	return nil
 }
 
-func enableSystemProxy(pacURL string) error {
-	out := bytes.NewBuffer(nil)
-	brookCmd := exec.Command(flagBinPath, "systemproxy",
-		"--url", pacURL)
-	brookCmd.Stdout = out
-	brookCmd.Stderr = out
-	if err := brookCmd.Start(); nil != err {
-		return err
+// buildPACSource assembles the PACSource the running instance will poll,
+// from -pac, -gfwlist-url and -pac-overrides. Multiple configured sources
+// are merged, with the user's overrides checked first.
+func buildPACSource(proxySpec string) (PACSource, error) {
+	var sources []PACSource
+	if "" != flagGFWListURL {
+		sources = append(sources, NewGFWListSource(flagGFWListURL, proxySpec))
+	}
+	// main fills in defaultPAC when -pac is unset, so only an explicit -pac
+	// is merged with -gfwlist-url.
+	pacExplicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if "pac" == f.Name {
+			pacExplicit = true
+		}
+	})
+	if "" != flagPAC && (pacExplicit || 0 == len(sources)) {
+		if strings.HasPrefix(flagPAC, "http://") || strings.HasPrefix(flagPAC, "https://") {
+			sources = append(sources, NewHTTPSource(flagPAC))
+		} else {
+			sources = append(sources, NewFileSource(strings.TrimPrefix(flagPAC, "file://")))
+		}
+	}
+	if 0 == len(sources) {
+		sources = append(sources, NewHTTPSource(defaultPAC))
+	}
+
+	overrides, err := loadPACOverrides(flagPACOverrides)
+	if nil != err {
+		return nil, err
 	}
-	if out.Len() != 0 {
-		return errors.New(out.String())
+
+	if 1 == len(sources) && 0 == len(overrides.Allow) && 0 == len(overrides.Deny) {
+		return sources[0], nil
 	}
-	return nil
+	return NewMergedSource(sources, overrides, proxySpec), nil
 }
 
 func main() {
@@ -128,14 +157,35 @@ func main() {
 	flag.StringVar(&flagPAC, "pac", "", "PAC file path")
 	flag.StringVar(&flagServer, "server", "", "Brook server address")
 	flag.StringVar(&flagPassword, "password", "", "Brook server password")
-	flag.BoolVar(&flagUpdate, "update", false, "Force to update the local pac file")
+	flag.BoolVar(&flagAutoUpgrade, "auto-upgrade", false, "Periodically check -upgrade-url for a newer brook binary and hot-swap it in without dropping the SOCKS listener")
+	flag.StringVar(&flagUpgradeURL, "upgrade-url", "", "URL of a JSON manifest {version,url,sha256,signature} describing the latest brook binary")
+	flag.StringVar(&flagUpgradePubKey, "upgrade-pubkey", "", "Hex-encoded ed25519 public key used to verify the manifest binary's signature")
+	flag.DurationVar(&flagPACRefresh, "pac-refresh", 0, "Re-fetch remote PAC sources on this interval and re-apply the system proxy on change (0 disables)")
+	flag.StringVar(&flagGFWListURL, "gfwlist-url", "", "URL of a base64-encoded gfwlist to compile into a PAC, merged with -pac if both are set")
+	flag.StringVar(&flagPACOverrides, "pac-overrides", "", "YAML file with allow/deny domain overrides applied on top of the PAC sources")
+	flag.StringVar(&flagServersConfig, "servers", "", "JSON or YAML file listing multiple brook servers {address,password,weight,region} to fail over between, instead of -server/-password")
+	flag.StringVar(&flagCanaryURL, "canary-url", "", "URL fetched through each candidate server during health checks, in addition to the plain TCP dial")
+	flag.DurationVar(&flagHealthInterval, "health-interval", time.Minute, "How often -servers entries are health-checked")
+	flag.IntVar(&flagHealthFailLimit, "health-fail-limit", 3, "Consecutive failed health checks before a server is classified bad")
 	flag.Parse()
 
-	if "" == flagServer || "" == flagPassword {
+	multiServer := "" != flagServersConfig
+	if !multiServer && ("" == flagServer || "" == flagPassword) {
 		flag.PrintDefaults()
 		return
 	}
 
+	var servers []serverConfig
+	var checker *healthChecker
+	if multiServer {
+		var err error
+		servers, err = loadServerConfigs(flagServersConfig)
+		if nil != err {
+			log.Fatal(err)
+			return
+		}
+	}
+
 	if "" == flagBinPath {
 		// Search for current directory
 		dir, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -157,30 +207,22 @@ func main() {
 		flagPAC = defaultPAC
 	}
 
-	if !Exists(pacLocalPath) || flagUpdate {
-		// Download pac file
-		log.Printf("Downloading pac file from %s ...", pacLocalPath)
-		rsp, err := http.Get(flagPAC)
-		if nil != err {
-			log.Fatalf("Can't download pac file: %v", err)
-			return
-		}
-		defer rsp.Body.Close()
-
-		data, err := ioutil.ReadAll(rsp.Body)
-		if nil != err || 0 == len(data) {
-			log.Fatalf("Download pac file error: %v", err)
-			return
-		}
-		if err = ioutil.WriteFile(pacLocalPath, data, 0644); nil != err {
-			log.Fatalf("Save pac file error: %v", err)
-			return
-		}
-	} else {
-		log.Printf("Using the cached pac file, run with -update argument to force update the pac file")
+	pacSource, err := buildPACSource(fmt.Sprintf("SOCKS5 %s; DIRECT", socksAddr))
+	if nil != err {
+		log.Fatal(err)
+		return
+	}
+	pacData, _, err := pacSource.Fetch()
+	if nil != err {
+		log.Fatal(err)
+		return
+	}
+	if err := ioutil.WriteFile(pacLocalPath, pacData, 0644); nil != err {
+		log.Fatalf("Save pac file error: %v", err)
+		return
 	}
 
-	// Launch local http server to serve pac file
+	// Launch local http server to serve pac file plus the control API
 	ls, err := net.Listen("tcp", "127.0.0.1:0")
 	if nil != err {
 		log.Fatalf("Serve http error: %v", err)
@@ -193,25 +235,170 @@ func main() {
 		return
 	}
 
+	proxyBackend := sysproxy.New()
+
+	brookOut := newBroadcastWriter(2000)
+
+	if multiServer {
+		checker = newHealthChecker(servers, flagBinPath, flagCanaryURL, flagHealthInterval, flagHealthFailLimit)
+		checkerStop := make(chan struct{})
+		defer close(checkerStop)
+		go checker.run(checkerStop)
+	}
+
+	// brooktool owns the SOCKS listener itself (instead of letting brook
+	// bind "--listen") so it can be handed from one brook child to the next
+	// across an upgrade without ever closing the socket. This requires a
+	// brook build that honors BROOK_LISTEN_FD/fd 3 the way it's passed below;
+	// see launchBrook.
+	socksLn, err := net.Listen("tcp", socksAddr)
+	if nil != err {
+		log.Fatalf("Can't listen on %s: %v", socksAddr, err)
+		return
+	}
+	defer socksLn.Close()
+	socksFile, err := socksLn.(*net.TCPListener).File()
+	if nil != err {
+		log.Fatalf("Can't get SOCKS listener fd: %v", err)
+		return
+	}
+	defer socksFile.Close()
+
+	type brookInstance struct {
+		cmd    *exec.Cmd
+		done   chan error
+		cancel context.CancelFunc
+		// running is set by the launchBrook goroutine that owns cmd, so
+		// readers like brookPID can check liveness without racing its
+		// unsynchronized cmd.Wait() call, which writes cmd.ProcessState.
+		running int32
+	}
+
+	var brookMu sync.Mutex
+	var current *brookInstance
+	var activeServer serverConfig
+	// excludedServers holds addresses we just failed over away from, each
+	// mapped to the time the exclusion lifts. Without a cooldown a server
+	// that blips once would be excluded forever even after the health
+	// checker reclassifies it "good" again, eventually draining the pool.
+	excludedServers := map[string]time.Time{}
+
+	// activeExclusions returns the addresses still inside their cooldown,
+	// pruning any that have expired.
+	activeExclusions := func() map[string]bool {
+		now := time.Now()
+		active := map[string]bool{}
+		for addr, until := range excludedServers {
+			if now.Before(until) {
+				active[addr] = true
+			} else {
+				delete(excludedServers, addr)
+			}
+		}
+		return active
+	}
+
+	// pickServer returns the server the next brook client should be launched
+	// against: the static -server/-password pair outside multi-server mode,
+	// or the health checker's current best candidate otherwise.
+	pickServer := func() (serverConfig, error) {
+		if !multiServer {
+			return serverConfig{Address: flagServer, Password: flagPassword}, nil
+		}
+		s, ok := checker.best(activeExclusions())
+		if !ok {
+			return serverConfig{}, fmt.Errorf("no healthy server available in %s", flagServersConfig)
+		}
+		return s, nil
+	}
+
+	activeServerAddr := func() string {
+		brookMu.Lock()
+		defer brookMu.Unlock()
+		return activeServer.Address
+	}
+	serverStatsFn := func() []serverStats {
+		if nil == checker {
+			return nil
+		}
+		return checker.snapshot()
+	}
+
+	brookPID := func() int {
+		brookMu.Lock()
+		inst := current
+		brookMu.Unlock()
+		// Check running first: until it's set, the owning goroutine may
+		// still be inside cmd.Start(), which writes cmd.Process
+		// unsynchronized, so touching cmd.Process before that check would
+		// race it.
+		if nil == inst || 0 == atomic.LoadInt32(&inst.running) || nil == inst.cmd.Process {
+			return 0
+		}
+		return inst.cmd.Process.Pid
+	}
+
+	type brookAction struct {
+		kind    string // "restart" or "handover"
+		binPath string
+		result  chan error
+	}
+	actionCh := make(chan brookAction, 4)
+	submitAction := func(kind, binPath string) error {
+		result := make(chan error, 1)
+		actionCh <- brookAction{kind: kind, binPath: binPath, result: result}
+		return <-result
+	}
+	restartBrook := func() error { return submitAction("restart", flagBinPath) }
+	handoverBrook := func(newBinPath string) error { return submitAction("handover", newBinPath) }
+
+	var activeServerFn func() string
+	var serverStatsFnArg func() []serverStats
+	if multiServer {
+		activeServerFn = activeServerAddr
+		serverStatsFnArg = serverStatsFn
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/pac", ph)
+	ch := newControlHandler(fmt.Sprintf("http://%s/pac", ls.Addr().String()), brookOut, brookPID,
+		func() error {
+			data, _, err := pacSource.Fetch()
+			if nil != err {
+				return err
+			}
+			if err := ioutil.WriteFile(pacLocalPath, data, 0644); nil != err {
+				return fmt.Errorf("Save pac file error: %v", err)
+			}
+			if err := ph.reload(); nil != err {
+				return err
+			}
+			return proxyBackend.Enable(fmt.Sprintf("http://%s/pac?ts=%d", ls.Addr().String(), time.Now().Unix()))
+		},
+		restartBrook, activeServerFn, serverStatsFnArg)
+	mux.Handle("/", ch)
+
 	go func(ls net.Listener) {
-		listenAddr := ls.Addr().String()
 		server := &http.Server{
-			Addr: listenAddr,
+			Addr:    ls.Addr().String(),
+			Handler: mux,
 		}
-		server.Handler = ph
 		if err := server.Serve(ls); !strings.Contains(err.Error(), "use of closed network connection") {
 			log.Fatalf("HTTP server stop serve with error: %v", err)
 		}
 	}(ls)
 
-	out := bytes.NewBuffer(nil)
-
 	// Enable system proxy
 	log.Print("Enable system proxy ...")
-	if err := enableSystemProxy(fmt.Sprintf("http://%s/pac", ls.Addr().String())); nil != err {
+	if err := proxyBackend.Enable(fmt.Sprintf("http://%s/pac", ls.Addr().String())); nil != err {
 		log.Fatalf("Enable system proxy error: %v", err)
 		return
 	}
+	// Runs on the clean shutdown path and on a panic in main's own goroutine.
+	// The log.Fatal exits below and panics in other goroutines skip deferred
+	// calls, so on those paths the system proxy is left pointed at the PAC
+	// server.
+	defer proxyBackend.Disable()
 
 	ctx, cancel := context.WithCancel(context.Background())
 
@@ -248,7 +435,7 @@ func main() {
 							closeMu.Unlock()
 							break
 						}
-						if err := enableSystemProxy(fmt.Sprintf("http://%s/pac?ts=%d", ls.Addr().String(), time.Now().Unix())); nil != err {
+						if err := proxyBackend.Enable(fmt.Sprintf("http://%s/pac?ts=%d", ls.Addr().String(), time.Now().Unix())); nil != err {
 							log.Printf("Failed to update pac config: %v", err)
 						} else {
 							log.Printf("Pac update successfully")
@@ -267,41 +454,217 @@ func main() {
 	}()
 	pacWatcher.Add(pacLocalPath)
 
-	out.Reset()
-	brookCh := make(chan error, 1)
-	go func() {
-		brookCmd := exec.CommandContext(ctx, flagBinPath, "client",
+	if flagPACRefresh > 0 {
+		go func() {
+			ticker := time.NewTicker(flagPACRefresh)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					data, changed, err := pacSource.Fetch()
+					if nil != err {
+						log.Printf("Scheduled pac refresh failed: %v", err)
+						continue
+					}
+					if !changed {
+						continue
+					}
+					if err := ioutil.WriteFile(pacLocalPath, data, 0644); nil != err {
+						log.Printf("Scheduled pac refresh failed to save: %v", err)
+						continue
+					}
+					if err := ph.reload(); nil != err {
+						log.Printf("Scheduled pac refresh failed to reload: %v", err)
+						continue
+					}
+					if err := proxyBackend.Enable(fmt.Sprintf("http://%s/pac?ts=%d", ls.Addr().String(), time.Now().Unix())); nil != err {
+						log.Printf("Scheduled pac refresh failed to re-apply system proxy: %v", err)
+					} else {
+						log.Printf("Scheduled pac refresh applied an update")
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// launchBrook starts a brook client against binPath/srv, inheriting the
+	// SOCKS listener fd (3) instead of letting brook bind its own. If
+	// readyFile is non-nil it's passed as a second extra fd (4) that brook
+	// can write a single byte to once it's accepting connections, used for
+	// zero-downtime handover during an upgrade.
+	launchBrook := func(binPath string, srv serverConfig, readyFile *os.File) *brookInstance {
+		brookCtx, cancelFn := context.WithCancel(ctx)
+		cmd := exec.CommandContext(brookCtx, binPath, "client",
 			"--ip", "127.0.0.1",
-			"--listen", "127.0.0.1:1080",
-			"--server", flagServer,
-			"--password", flagPassword,
+			"--server", srv.Address,
+			"--password", srv.Password,
 		)
-		brookCmd.Stdout = out
-		brookCmd.Stderr = out
-		startErr := brookCmd.Start()
-		if nil != startErr {
-			brookCh <- err
+		cmd.Stdout = brookOut
+		cmd.Stderr = brookOut
+		cmd.ExtraFiles = []*os.File{socksFile}
+		env := append(append([]string{}, os.Environ()...), "BROOK_LISTEN_FD=3")
+		if nil != readyFile {
+			cmd.ExtraFiles = append(cmd.ExtraFiles, readyFile)
+			env = append(env, "BROOK_READY_FD=4")
+		}
+		cmd.Env = env
+
+		inst := &brookInstance{cmd: cmd, done: make(chan error, 1), cancel: cancelFn}
+		go func() {
+			if err := cmd.Start(); nil != err {
+				inst.done <- err
+				return
+			}
+			atomic.StoreInt32(&inst.running, 1)
+			log.Printf("Brook client (%s) is running against %s, SOCKS listener inherited on %s", binPath, srv.Address, socksAddr)
+			err := cmd.Wait()
+			atomic.StoreInt32(&inst.running, 0)
+			inst.done <- err
+		}()
+		return inst
+	}
+
+	firstServer, err := pickServer()
+	if nil != err {
+		log.Fatal(err)
+		return
+	}
+	brookMu.Lock()
+	activeServer = firstServer
+	current = launchBrook(flagBinPath, firstServer, nil)
+	brookMu.Unlock()
+
+	// doHandover starts newBinPath alongside the running client, waits for it
+	// to either signal readiness on its ready fd or a short grace period to
+	// pass, promotes it to current, and only then asks the old child to quit.
+	// Because both children inherit the same listening socket, in-flight
+	// connections accepted by the old child keep being served by it until it
+	// exits, and new connections land on whichever child's accept loop wins
+	// the race, so the port is never unbound.
+	doHandover := func(newBinPath string) error {
+		readyR, readyW, err := os.Pipe()
+		if nil != err {
+			return fmt.Errorf("create ready pipe: %v", err)
+		}
+
+		brookMu.Lock()
+		old := current
+		srv := activeServer
+		brookMu.Unlock()
+
+		newInst := launchBrook(newBinPath, srv, readyW)
+		readyW.Close()
+
+		readyCh := make(chan struct{})
+		go func() {
+			buf := make([]byte, 1)
+			if _, err := readyR.Read(buf); nil == err {
+				close(readyCh)
+			}
+		}()
+
+		select {
+		case <-readyCh:
+			log.Printf("New brook client signalled ready")
+		case <-time.After(10 * time.Second):
+			log.Printf("New brook client did not signal readiness within 10s, proceeding anyway")
+		case err := <-newInst.done:
+			readyR.Close()
+			return fmt.Errorf("new brook client exited before becoming ready: %v", err)
+		}
+		readyR.Close()
+
+		brookMu.Lock()
+		current = newInst
+		brookMu.Unlock()
+
+		if nil != old.cmd.Process {
+			old.cmd.Process.Signal(syscall.SIGTERM)
+		}
+		return nil
+	}
+
+	if flagAutoUpgrade {
+		if "" == flagUpgradeURL {
+			log.Fatal("-auto-upgrade requires -upgrade-url")
 			return
 		}
-		log.Printf("Brook client is start with address 127.0.0.1:1080")
-		brookCh <- brookCmd.Wait()
-	}()
+		pubKey, err := loadUpgradePubKey(flagUpgradePubKey)
+		if nil != err {
+			log.Fatal(err)
+			return
+		}
+		up := newUpgrader(flagBinPath, flagUpgradeURL, pubKey, upgradeCheckInterval, handoverBrook)
+		upgradeStop := make(chan struct{})
+		defer close(upgradeStop)
+		go up.run(upgradeStop)
+	}
+
+	// Ignore SIGHUP so closing the terminal that launched brooktool doesn't
+	// tear down the proxy; only an explicit SIGINT/SIGTERM/SIGQUIT (or a
+	// panic in main's goroutine, caught by the deferred Disable above)
+	// restores it.
+	signal.Ignore(syscall.SIGHUP)
 
 	// Wait for signals to quit
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	running := true
+	for running {
+		brookMu.Lock()
+		doneCh := current.done
+		brookMu.Unlock()
 
-	select {
-	case recvSig := <-sigCh:
-		{
+		select {
+		case recvSig := <-sigCh:
 			log.Printf("Recv %v signal, shutting down ...", recvSig)
 			cancel()
-			<-brookCh
-		}
-	case brookErr := <-brookCh:
-		{
-			log.Printf("Brook occurs an error: %v (%v)", brookErr, out.String())
-			cancel()
+			<-doneCh
+			running = false
+		case brookErr := <-doneCh:
+			log.Printf("Brook occurs an error: %v (%v)", brookErr, brookOut.String())
+			if !multiServer {
+				cancel()
+				running = false
+				break
+			}
+			brookMu.Lock()
+			failedAddr := activeServer.Address
+			brookMu.Unlock()
+			checker.markFailed(failedAddr)
+			excludedServers[failedAddr] = time.Now().Add(serverExcludeCooldown)
+			next, pickErr := pickServer()
+			if nil != pickErr {
+				log.Printf("No server to fail over to, shutting down: %v", pickErr)
+				cancel()
+				running = false
+				break
+			}
+			log.Printf("Failing over from %s to %s", failedAddr, next.Address)
+			brookMu.Lock()
+			activeServer = next
+			current = launchBrook(flagBinPath, next, nil)
+			brookMu.Unlock()
+		case action := <-actionCh:
+			switch action.kind {
+			case "restart":
+				log.Printf("Restarting brook client ...")
+				brookMu.Lock()
+				old := current
+				srv := activeServer
+				brookMu.Unlock()
+				old.cancel()
+				<-old.done
+				brookMu.Lock()
+				current = launchBrook(flagBinPath, srv, nil)
+				brookMu.Unlock()
+				action.result <- nil
+			case "handover":
+				action.result <- doHandover(action.binPath)
+			}
 		}
 	}
 	closeMu.Lock()
@@ -311,18 +674,10 @@ func main() {
 
 	// Disable system proxy
 	log.Print("Disable system proxy ...")
-	out.Reset()
-	brookCmd := exec.Command(flagBinPath, "systemproxy", "-r")
-	brookCmd.Stdout = out
-	brookCmd.Stderr = out
-	if err := brookCmd.Start(); nil != err {
+	if err := proxyBackend.Disable(); nil != err {
 		log.Fatalf("Disable system proxy error: %v", err)
 		return
 	}
-	if out.Len() != 0 {
-		log.Fatalf("Disable system proxy error: %v", out.String())
-		return
-	}
 
 	log.Printf("Bye ...")
 }
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// PACSource produces a PAC script and reports whether its content changed
+// since the previous call, so a caller driven by -pac-refresh only needs to
+// re-apply the system proxy when something actually moved.
+type PACSource interface {
+	Fetch() (data []byte, changed bool, err error)
+}
+
+// HTTPSource downloads a PAC file over HTTP(S), using ETag/If-Modified-Since
+// so an unchanged upstream doesn't cost a full re-download.
+type HTTPSource struct {
+	URL string
+
+	etag         string
+	lastModified string
+	cached       []byte
+}
+
+func NewHTTPSource(url string) *HTTPSource {
+	return &HTTPSource{URL: url}
+}
+
+func (s *HTTPSource) Fetch() ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	if nil != err {
+		return nil, false, err
+	}
+	if "" != s.etag {
+		req.Header.Set("If-None-Match", s.etag)
+	}
+	if "" != s.lastModified {
+		req.Header.Set("If-Modified-Since", s.lastModified)
+	}
+
+	rsp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		return nil, false, fmt.Errorf("fetch pac from %s: %v", s.URL, err)
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode == http.StatusNotModified {
+		return s.cached, false, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("fetch pac from %s: unexpected status %s", s.URL, rsp.Status)
+	}
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if nil != err || 0 == len(data) {
+		return nil, false, fmt.Errorf("read pac from %s: %v", s.URL, err)
+	}
+
+	s.etag = rsp.Header.Get("ETag")
+	s.lastModified = rsp.Header.Get("Last-Modified")
+	s.cached = data
+	return data, true, nil
+}
+
+// FileSource reads a PAC file from local disk, re-reading only when its
+// mtime advances.
+type FileSource struct {
+	Path string
+
+	modTime time.Time
+	cached  []byte
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{Path: path}
+}
+
+func (s *FileSource) Fetch() ([]byte, bool, error) {
+	fi, err := os.Stat(s.Path)
+	if nil != err {
+		return nil, false, fmt.Errorf("stat pac file %s: %v", s.Path, err)
+	}
+	if nil != s.cached && !fi.ModTime().After(s.modTime) {
+		return s.cached, false, nil
+	}
+
+	data, err := ioutil.ReadFile(s.Path)
+	if nil != err {
+		return nil, false, fmt.Errorf("read pac file %s: %v", s.Path, err)
+	}
+	s.modTime = fi.ModTime()
+	s.cached = data
+	return data, true, nil
+}
+
+// autoProxyRules is the subset of gfwlist's AutoProxy syntax brooktool
+// compiles: ||domain, |prefix, /regex/ and plain substrings, each optionally
+// negated with an @@ exception.
+type autoProxyRules struct {
+	proxyDomains, directDomains   []string
+	proxyPrefixes, directPrefixes []string
+	proxyRegexps, directRegexps   []string
+	proxyPlain, directPlain       []string
+}
+
+func parseAutoProxyList(text string) autoProxyRules {
+	var rules autoProxyRules
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if "" == line || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		except := false
+		if strings.HasPrefix(line, "@@") {
+			except = true
+			line = line[2:]
+		}
+
+		switch {
+		case strings.HasPrefix(line, "||"):
+			if except {
+				rules.directDomains = append(rules.directDomains, line[2:])
+			} else {
+				rules.proxyDomains = append(rules.proxyDomains, line[2:])
+			}
+		case strings.HasPrefix(line, "|"):
+			if except {
+				rules.directPrefixes = append(rules.directPrefixes, line[1:])
+			} else {
+				rules.proxyPrefixes = append(rules.proxyPrefixes, line[1:])
+			}
+		case strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") && len(line) > 1:
+			expr := line[1 : len(line)-1]
+			if except {
+				rules.directRegexps = append(rules.directRegexps, expr)
+			} else {
+				rules.proxyRegexps = append(rules.proxyRegexps, expr)
+			}
+		default:
+			if except {
+				rules.directPlain = append(rules.directPlain, line)
+			} else {
+				rules.proxyPlain = append(rules.proxyPlain, line)
+			}
+		}
+	}
+	return rules
+}
+
+// pacMatcherJS is shared by every compiled PAC so the generated scripts stay
+// small; redeclaring it across sources merged by MergedSource is harmless
+// since each copy is identical.
+const pacMatcherJS = `
+function __btMatchHost(host, domains) {
+	for (var i = 0; i < domains.length; i++) {
+		var d = domains[i];
+		if (host === d || (host.length > d.length && host.substr(host.length - d.length - 1) === "." + d)) {
+			return true;
+		}
+	}
+	return false;
+}
+function __btMatchPrefix(url, prefixes) {
+	for (var i = 0; i < prefixes.length; i++) {
+		if (url.indexOf(prefixes[i]) === 0) {
+			return true;
+		}
+	}
+	return false;
+}
+function __btMatchRegexp(url, patterns) {
+	for (var i = 0; i < patterns.length; i++) {
+		if (new RegExp(patterns[i]).test(url)) {
+			return true;
+		}
+	}
+	return false;
+}
+function __btMatchPlain(url, needles) {
+	for (var i = 0; i < needles.length; i++) {
+		if (url.indexOf(needles[i]) !== -1) {
+			return true;
+		}
+	}
+	return false;
+}
+`
+
+func jsStringArray(items []string) string {
+	quoted := make([]string, len(items))
+	for i, s := range items {
+		quoted[i] = fmt.Sprintf("%q", s)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// compilePACFromRules renders rules into a FindProxyForURL that returns
+// proxySpec (e.g. "SOCKS5 127.0.0.1:1080; DIRECT") for proxied hosts. The
+// rule arrays are declared inside FindProxyForURL itself rather than as
+// top-level vars, so two compiled PACs can be concatenated into one scope
+// (as MergedSource does) without one's rule arrays shadowing the other's.
+func compilePACFromRules(rules autoProxyRules, proxySpec string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(pacMatcherJS)
+	fmt.Fprintf(&buf, `
+function FindProxyForURL(url, host) {
+	var directDomains = %s;
+	var directPrefixes = %s;
+	var directRegexps = %s;
+	var directPlain = %s;
+	var proxyDomains = %s;
+	var proxyPrefixes = %s;
+	var proxyRegexps = %s;
+	var proxyPlain = %s;
+	if (__btMatchHost(host, directDomains) || __btMatchPrefix(url, directPrefixes) || __btMatchRegexp(url, directRegexps) || __btMatchPlain(url, directPlain)) {
+		return "DIRECT";
+	}
+	if (__btMatchHost(host, proxyDomains) || __btMatchPrefix(url, proxyPrefixes) || __btMatchRegexp(url, proxyRegexps) || __btMatchPlain(url, proxyPlain)) {
+		return %q;
+	}
+	return "DIRECT";
+}
+`,
+		jsStringArray(rules.directDomains), jsStringArray(rules.directPrefixes),
+		jsStringArray(rules.directRegexps), jsStringArray(rules.directPlain),
+		jsStringArray(rules.proxyDomains), jsStringArray(rules.proxyPrefixes),
+		jsStringArray(rules.proxyRegexps), jsStringArray(rules.proxyPlain),
+		proxySpec)
+	return buf.Bytes()
+}
+
+// GFWListSource fetches the base64-encoded gfwlist and compiles its
+// AutoProxy rules into a PAC targeting the local SOCKS proxy.
+type GFWListSource struct {
+	URL       string
+	ProxySpec string
+
+	http   *HTTPSource
+	cached []byte
+}
+
+func NewGFWListSource(url, proxySpec string) *GFWListSource {
+	return &GFWListSource{URL: url, ProxySpec: proxySpec, http: NewHTTPSource(url)}
+}
+
+func (s *GFWListSource) Fetch() ([]byte, bool, error) {
+	raw, changed, err := s.http.Fetch()
+	if nil != err {
+		return nil, false, err
+	}
+	if !changed {
+		return s.cached, false, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if nil != err {
+		return nil, false, fmt.Errorf("decode gfwlist: %v", err)
+	}
+
+	rules := parseAutoProxyList(string(decoded))
+	s.cached = compilePACFromRules(rules, s.ProxySpec)
+	return s.cached, true, nil
+}
+
+// pacOverrides lets users pin specific domains to always go DIRECT or always
+// go PROXY, regardless of what the underlying sources decide.
+type pacOverrides struct {
+	Allow []string `yaml:"allow"` // always PROXY
+	Deny  []string `yaml:"deny"`  // always DIRECT
+}
+
+func loadPACOverrides(path string) (pacOverrides, error) {
+	var o pacOverrides
+	if "" == path {
+		return o, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return o, fmt.Errorf("read pac overrides %s: %v", path, err)
+	}
+	if err := yaml.Unmarshal(data, &o); nil != err {
+		return o, fmt.Errorf("parse pac overrides %s: %v", path, err)
+	}
+	return o, nil
+}
+
+var findProxyFuncRe = regexp.MustCompile(`function\s+FindProxyForURL\s*\(`)
+
+// MergedSource unions several PACSources: each member's FindProxyForURL is
+// consulted in order and the first to return a verdict starting with PROXY
+// or SOCKS wins (any other verdict counts as DIRECT), with
+// the user's allow/deny overrides checked first.
+type MergedSource struct {
+	Sources   []PACSource
+	Overrides pacOverrides
+	ProxySpec string
+
+	fetched bool
+}
+
+func NewMergedSource(sources []PACSource, overrides pacOverrides, proxySpec string) *MergedSource {
+	return &MergedSource{Sources: sources, Overrides: overrides, ProxySpec: proxySpec}
+}
+
+func (s *MergedSource) Fetch() ([]byte, bool, error) {
+	changed := !s.fetched
+
+	var buf bytes.Buffer
+	buf.WriteString(pacMatcherJS)
+	fmt.Fprintf(&buf, "var overrideAllow = %s;\n", jsStringArray(s.Overrides.Allow))
+	fmt.Fprintf(&buf, "var overrideDeny = %s;\n", jsStringArray(s.Overrides.Deny))
+
+	delegates := make([]string, 0, len(s.Sources))
+	for i, src := range s.Sources {
+		data, srcChanged, err := src.Fetch()
+		if nil != err {
+			return nil, false, err
+		}
+		if srcChanged {
+			changed = true
+		}
+		name := fmt.Sprintf("__btDelegate%d", i)
+		buf.WriteString(findProxyFuncRe.ReplaceAllString(string(data), "function "+name+"("))
+		buf.WriteString("\n")
+		delegates = append(delegates, name)
+	}
+
+	buf.WriteString("function FindProxyForURL(url, host) {\n")
+	buf.WriteString("\tif (__btMatchHost(host, overrideDeny)) return \"DIRECT\";\n")
+	fmt.Fprintf(&buf, "\tif (__btMatchHost(host, overrideAllow)) return %q;\n", s.ProxySpec)
+	for _, name := range delegates {
+		fmt.Fprintf(&buf, "\tvar r%s = %s(url, host);\n\tif (r%s.indexOf(\"PROXY\") === 0 || r%s.indexOf(\"SOCKS\") === 0) return r%s;\n", name, name, name, name, name)
+	}
+	buf.WriteString("\treturn \"DIRECT\";\n}\n")
+
+	s.fetched = true
+	return buf.Bytes(), changed, nil
+}
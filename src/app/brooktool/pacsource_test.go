@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseAutoProxyList(t *testing.T) {
+	list := `! comment line
+[AutoProxy 0.2.9]
+||proxy.example.com
+|http://direct-prefix.example.com
+@@||allow.example.com
+@@|http://allow-prefix.example.com
+/^https?:\/\/regex\.example\.com/
+@@/^https?:\/\/allow-regex\.example\.com/
+plainneedle
+@@plainallow
+`
+	rules := parseAutoProxyList(list)
+
+	assertStrings := func(name string, got []string, want ...string) {
+		if len(got) != len(want) {
+			t.Fatalf("%s = %v, want %v", name, got, want)
+		}
+		for i, w := range want {
+			if got[i] != w {
+				t.Fatalf("%s = %v, want %v", name, got, want)
+			}
+		}
+	}
+
+	assertStrings("proxyDomains", rules.proxyDomains, "proxy.example.com")
+	assertStrings("directDomains", rules.directDomains, "allow.example.com")
+	assertStrings("proxyPrefixes", rules.proxyPrefixes, "http://direct-prefix.example.com")
+	assertStrings("directPrefixes", rules.directPrefixes, "http://allow-prefix.example.com")
+	assertStrings("proxyRegexps", rules.proxyRegexps, `^https?:\/\/regex\.example\.com`)
+	assertStrings("directRegexps", rules.directRegexps, `^https?:\/\/allow-regex\.example\.com`)
+	assertStrings("proxyPlain", rules.proxyPlain, "plainneedle")
+	assertStrings("directPlain", rules.directPlain, "plainallow")
+}
+
+func TestCompilePACFromRules(t *testing.T) {
+	rules := parseAutoProxyList("||proxy.example.com\n@@||allow.example.com\n")
+	pac := string(compilePACFromRules(rules, "SOCKS5 127.0.0.1:1080; DIRECT"))
+
+	if !strings.Contains(pac, "function FindProxyForURL(url, host)") {
+		t.Fatalf("compiled PAC is missing FindProxyForURL:\n%s", pac)
+	}
+	if !strings.Contains(pac, `"proxy.example.com"`) {
+		t.Fatalf("compiled PAC is missing the proxied domain:\n%s", pac)
+	}
+	if !strings.Contains(pac, `"allow.example.com"`) {
+		t.Fatalf("compiled PAC is missing the direct exception domain:\n%s", pac)
+	}
+	if !strings.Contains(pac, "SOCKS5 127.0.0.1:1080; DIRECT") {
+		t.Fatalf("compiled PAC doesn't return the configured proxy spec:\n%s", pac)
+	}
+}
+
+// fakeSource is a PACSource standing in for HTTPSource/FileSource/
+// GFWListSource: with changedOnce set it reports changed on its first Fetch
+// only, like a real source whose cache is already warm by the second call;
+// without it, it never reports changed.
+type fakeSource struct {
+	data           []byte
+	changedOnce    bool
+	alreadyFetched bool
+}
+
+func (s *fakeSource) Fetch() ([]byte, bool, error) {
+	changed := s.changedOnce && !s.alreadyFetched
+	s.alreadyFetched = true
+	return s.data, changed, nil
+}
+
+func TestMergedSourceFetch(t *testing.T) {
+	a := &fakeSource{data: compilePACFromRules(parseAutoProxyList("||a.example.com\n"), "SOCKS5 127.0.0.1:1080; DIRECT"), changedOnce: true}
+	b := &fakeSource{data: compilePACFromRules(parseAutoProxyList("||b.example.com\n"), "SOCKS5 127.0.0.1:1080; DIRECT")}
+
+	overrides := pacOverrides{Allow: []string{"force-proxy.example.com"}, Deny: []string{"force-direct.example.com"}}
+	merged := NewMergedSource([]PACSource{a, b}, overrides, "SOCKS5 127.0.0.1:1080; DIRECT")
+
+	data, changed, err := merged.Fetch()
+	if nil != err {
+		t.Fatalf("Fetch() error: %v", err)
+	}
+	if !changed {
+		t.Fatal("Fetch() changed = false, want true because one delegate source changed")
+	}
+
+	js := string(data)
+	if !strings.Contains(js, "function __btDelegate0(") || !strings.Contains(js, "function __btDelegate1(") {
+		t.Fatalf("merged PAC is missing one of the renamed delegate functions:\n%s", js)
+	}
+	if !strings.Contains(js, "force-proxy.example.com") || !strings.Contains(js, "force-direct.example.com") {
+		t.Fatalf("merged PAC is missing the override domains:\n%s", js)
+	}
+
+	_, changed2, err := merged.Fetch()
+	if nil != err {
+		t.Fatalf("second Fetch() error: %v", err)
+	}
+	if changed2 {
+		t.Fatal("second Fetch() changed = true, want false because no delegate changed and fetched was already true")
+	}
+}
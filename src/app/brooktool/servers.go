@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// serverConfig describes one brook server entry from a -servers file.
+type serverConfig struct {
+	Address  string `json:"address" yaml:"address"`
+	Password string `json:"password" yaml:"password"`
+	// Weight biases selection among servers classified "good": a higher
+	// weight wins over a lower one at comparable latency. Unset or <= 0 is
+	// treated as 1.
+	Weight int    `json:"weight" yaml:"weight"`
+	Region string `json:"region,omitempty" yaml:"region,omitempty"`
+}
+
+// loadServerConfigs reads a JSON or YAML file (chosen by extension) listing
+// multiple brook servers to pick between.
+func loadServerConfigs(path string) ([]serverConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if nil != err {
+		return nil, fmt.Errorf("read servers config %s: %v", path, err)
+	}
+
+	var servers []serverConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &servers)
+	default:
+		err = json.Unmarshal(data, &servers)
+	}
+	if nil != err {
+		return nil, fmt.Errorf("parse servers config %s: %v", path, err)
+	}
+	if 0 == len(servers) {
+		return nil, fmt.Errorf("servers config %s has no servers", path)
+	}
+	for _, s := range servers {
+		if "" == s.Address || "" == s.Password {
+			return nil, fmt.Errorf("servers config %s: every server needs an address and password", path)
+		}
+	}
+	return servers, nil
+}
@@ -0,0 +1,30 @@
+// Package sysproxy applies and clears a PAC-based system proxy setting
+// natively on the current OS, replacing the old approach of shelling out to
+// brook's own "systemproxy" subcommand.
+package sysproxy
+
+import "fmt"
+
+// Settings describes the system's current proxy auto-config state.
+type Settings struct {
+	Enabled bool
+	PACURL  string
+}
+
+// Backend applies or clears a PAC URL as the system's proxy auto-config
+// setting. Implementations are platform-specific; New picks the right one
+// for the host OS.
+type Backend interface {
+	Enable(pacURL string) error
+	Disable() error
+	Current() (Settings, error)
+}
+
+// New returns the Backend for the current OS.
+func New() Backend {
+	return newBackend()
+}
+
+func errUnsupported(what string) error {
+	return fmt.Errorf("sysproxy: %s not supported on this platform", what)
+}
@@ -0,0 +1,101 @@
+//go:build darwin
+// +build darwin
+
+package sysproxy
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+type darwinBackend struct{}
+
+func newBackend() Backend {
+	return &darwinBackend{}
+}
+
+func (b *darwinBackend) Enable(pacURL string) error {
+	services, err := activeNetworkServices()
+	if nil != err {
+		return err
+	}
+	for _, svc := range services {
+		if err := run("networksetup", "-setautoproxyurl", svc, pacURL); nil != err {
+			return fmt.Errorf("set autoproxyurl for %q: %v", svc, err)
+		}
+		if err := run("networksetup", "-setautoproxystate", svc, "on"); nil != err {
+			return fmt.Errorf("enable autoproxy for %q: %v", svc, err)
+		}
+	}
+	return nil
+}
+
+func (b *darwinBackend) Disable() error {
+	services, err := activeNetworkServices()
+	if nil != err {
+		return err
+	}
+	for _, svc := range services {
+		if err := run("networksetup", "-setautoproxystate", svc, "off"); nil != err {
+			return fmt.Errorf("disable autoproxy for %q: %v", svc, err)
+		}
+	}
+	return nil
+}
+
+func (b *darwinBackend) Current() (Settings, error) {
+	services, err := activeNetworkServices()
+	if nil != err || 0 == len(services) {
+		return Settings{}, err
+	}
+	out, err := exec.Command("networksetup", "-getautoproxyurl", services[0]).Output()
+	if nil != err {
+		return Settings{}, fmt.Errorf("getautoproxyurl for %q: %v", services[0], err)
+	}
+
+	var pacURL string
+	enabled := false
+	for _, line := range strings.Split(string(out), "\n") {
+		switch {
+		case strings.HasPrefix(line, "URL: "):
+			pacURL = strings.TrimPrefix(line, "URL: ")
+		case strings.HasPrefix(line, "Enabled: "):
+			enabled = "Yes" == strings.TrimPrefix(line, "Enabled: ")
+		}
+	}
+	return Settings{Enabled: enabled, PACURL: pacURL}, nil
+}
+
+// activeNetworkServices lists the network services networksetup knows about,
+// in the order networksetup -listallnetworkservices prints them, skipping the
+// disabled ones it marks with a leading "*". scutil is not consulted, so
+// enabled services that are not currently connected are included too.
+func activeNetworkServices() ([]string, error) {
+	out, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if nil != err {
+		return nil, fmt.Errorf("listallnetworkservices: %v", err)
+	}
+
+	var services []string
+	for i, line := range strings.Split(string(out), "\n") {
+		if 0 == i {
+			// First line is a header ("An asterisk (*) denotes...").
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if "" == line || strings.HasPrefix(line, "*") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+func run(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if nil != err {
+		return fmt.Errorf("%v: %s", err, string(out))
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !windows && !darwin && !linux
+// +build !windows,!darwin,!linux
+
+package sysproxy
+
+type unsupportedBackend struct{}
+
+func newBackend() Backend {
+	return &unsupportedBackend{}
+}
+
+func (b *unsupportedBackend) Enable(pacURL string) error {
+	return errUnsupported("enabling the system proxy")
+}
+
+func (b *unsupportedBackend) Disable() error {
+	return errUnsupported("disabling the system proxy")
+}
+
+func (b *unsupportedBackend) Current() (Settings, error) {
+	return Settings{}, errUnsupported("reading the system proxy")
+}
@@ -0,0 +1,86 @@
+//go:build windows
+// +build windows
+
+package sysproxy
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/windows/registry"
+)
+
+const internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// These match wininet.h; INTERNET_OPTION_SETTINGS_CHANGED and
+// INTERNET_OPTION_REFRESH tell every process sharing the per-user proxy
+// config (including Explorer) to pick up the registry change immediately,
+// the same notification wininet.dll itself sends after its own proxy APIs.
+const (
+	internetOptionSettingsChanged = 39
+	internetOptionRefresh         = 37
+)
+
+var (
+	wininet                = syscall.NewLazyDLL("wininet.dll")
+	procInternetSetOptionW = wininet.NewProc("InternetSetOptionW")
+)
+
+type windowsBackend struct{}
+
+func newBackend() Backend {
+	return &windowsBackend{}
+}
+
+func (b *windowsBackend) Enable(pacURL string) error {
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, internetSettingsKey, registry.SET_VALUE)
+	if nil != err {
+		return fmt.Errorf("open internet settings key: %v", err)
+	}
+	defer key.Close()
+
+	if err := key.SetDWordValue("ProxyEnable", 0); nil != err {
+		return fmt.Errorf("clear ProxyEnable: %v", err)
+	}
+	if err := key.SetStringValue("AutoConfigURL", pacURL); nil != err {
+		return fmt.Errorf("set AutoConfigURL: %v", err)
+	}
+	return notifyInternetSettingsChanged()
+}
+
+func (b *windowsBackend) Disable() error {
+	key, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.SET_VALUE)
+	if nil != err {
+		return fmt.Errorf("open internet settings key: %v", err)
+	}
+	defer key.Close()
+
+	if err := key.DeleteValue("AutoConfigURL"); nil != err && err != registry.ErrNotExist {
+		return fmt.Errorf("clear AutoConfigURL: %v", err)
+	}
+	return notifyInternetSettingsChanged()
+}
+
+func (b *windowsBackend) Current() (Settings, error) {
+	key, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE)
+	if nil != err {
+		return Settings{}, fmt.Errorf("open internet settings key: %v", err)
+	}
+	defer key.Close()
+
+	pacURL, _, err := key.GetStringValue("AutoConfigURL")
+	if nil != err && err != registry.ErrNotExist {
+		return Settings{}, fmt.Errorf("read AutoConfigURL: %v", err)
+	}
+	return Settings{Enabled: "" != pacURL, PACURL: pacURL}, nil
+}
+
+func notifyInternetSettingsChanged() error {
+	if ret, _, err := procInternetSetOptionW.Call(0, internetOptionSettingsChanged, 0, 0); 0 == ret {
+		return fmt.Errorf("InternetSetOption(SETTINGS_CHANGED): %v", err)
+	}
+	if ret, _, err := procInternetSetOptionW.Call(0, internetOptionRefresh, 0, 0); 0 == ret {
+		return fmt.Errorf("InternetSetOption(REFRESH): %v", err)
+	}
+	return nil
+}
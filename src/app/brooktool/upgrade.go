@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// upgradeManifest describes a downloadable binary and how to verify it,
+// served from -upgrade-url.
+type upgradeManifest struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature,omitempty"` // hex-encoded ed25519 signature over the raw binary, optional
+}
+
+// upgrader periodically polls a manifest URL for a newer brook binary,
+// verifies it against its checksum (and signature, if a public key was
+// configured), swaps it into place, and hands the running client over to
+// the new binary via handover.
+type upgrader struct {
+	binPath     string
+	manifestURL string
+	pubKey      ed25519.PublicKey // nil disables signature verification
+	interval    time.Duration
+	handover    func(newBinPath string) error
+
+	version string
+}
+
+func newUpgrader(binPath, manifestURL string, pubKey ed25519.PublicKey, interval time.Duration, handover func(string) error) *upgrader {
+	return &upgrader{
+		binPath:     binPath,
+		manifestURL: manifestURL,
+		pubKey:      pubKey,
+		interval:    interval,
+		handover:    handover,
+		version:     installedVersion(binPath),
+	}
+}
+
+// installedVersion best-effort runs binPath --version and returns its
+// trimmed output, or "" if that fails. Seeding u.version from it means the
+// first manifest poll is a no-op when the installed binary is already
+// current, instead of always handing over on startup.
+func installedVersion(binPath string) string {
+	out, err := exec.Command(binPath, "--version").CombinedOutput()
+	if nil != err {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func (u *upgrader) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := u.checkOnce(); nil != err {
+				log.Printf("Auto-upgrade check failed: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (u *upgrader) fetchManifest() (*upgradeManifest, error) {
+	rsp, err := http.Get(u.manifestURL)
+	if nil != err {
+		return nil, fmt.Errorf("fetch upgrade manifest: %v", err)
+	}
+	defer rsp.Body.Close()
+
+	var m upgradeManifest
+	if err := json.NewDecoder(rsp.Body).Decode(&m); nil != err {
+		return nil, fmt.Errorf("decode upgrade manifest: %v", err)
+	}
+	return &m, nil
+}
+
+// checkOnce polls the manifest once and, if it names a version we don't
+// already have installed, downloads, verifies, installs and hands over to it.
+func (u *upgrader) checkOnce() error {
+	manifest, err := u.fetchManifest()
+	if nil != err {
+		return err
+	}
+	if manifest.Version == u.version {
+		return nil
+	}
+
+	rsp, err := http.Get(manifest.URL)
+	if nil != err {
+		return fmt.Errorf("download new binary: %v", err)
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if nil != err {
+		return fmt.Errorf("read new binary: %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), manifest.SHA256) {
+		return fmt.Errorf("sha256 mismatch for new binary (version %s)", manifest.Version)
+	}
+	if nil != u.pubKey {
+		sig, err := hex.DecodeString(manifest.Signature)
+		if nil != err {
+			return fmt.Errorf("decode signature: %v", err)
+		}
+		if !ed25519.Verify(u.pubKey, data, sig) {
+			return fmt.Errorf("signature verification failed for new binary (version %s)", manifest.Version)
+		}
+	}
+
+	tmpPath := u.binPath + ".new"
+	if err := ioutil.WriteFile(tmpPath, data, 0755); nil != err {
+		return fmt.Errorf("save new binary: %v", err)
+	}
+	if err := os.Rename(tmpPath, u.binPath); nil != err {
+		os.Remove(tmpPath)
+		return fmt.Errorf("install new binary: %v", err)
+	}
+
+	log.Printf("Installed brook binary version %s, handing the client over ...", manifest.Version)
+	if err := u.handover(u.binPath); nil != err {
+		return fmt.Errorf("handover to new binary: %v", err)
+	}
+	u.version = manifest.Version
+	return nil
+}
+
+// loadUpgradePubKey parses a hex-encoded ed25519 public key, or returns nil
+// if hexKey is empty.
+func loadUpgradePubKey(hexKey string) (ed25519.PublicKey, error) {
+	if "" == hexKey {
+		return nil, nil
+	}
+	raw, err := hex.DecodeString(hexKey)
+	if nil != err {
+		return nil, fmt.Errorf("decode -upgrade-pubkey: %v", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("-upgrade-pubkey must be %d bytes, got %d", ed25519.PublicKeySize, len(raw))
+	}
+	return ed25519.PublicKey(raw), nil
+}